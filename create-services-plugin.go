@@ -2,19 +2,42 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"code.cloudfoundry.org/cli/plugin"
+	yaml "gopkg.in/yaml.v2"
 )
 
 // Create-Service-Push is the struct implementing the interface defined by the core CLI. It can
 // be found at  "code.cloudfoundry.org/cli/plugin/plugin.go"
 type CreateServicePush struct {
-	manifest *Manifest
-	cf       plugin.CliConnection
+	manifest       *Manifest
+	cf             plugin.CliConnection
+	updateServices bool
+	parallel       int
+
+	// out, when set, is where progress-spinner output is written. Defaults to
+	// os.Stdout; set to a serializedWriter when services are created concurrently.
+	out io.Writer
+
+	// stateFilePath and target, when set, let createService/
+	// createUserProvidedService detect manifest drift that isn't visible
+	// through the CF API (changed -c parameters, CUPS credentials) by
+	// comparing against the hash recorded the last time this plugin
+	// successfully applied the entry. See manifestHashChanged.
+	stateFilePath string
+	target        string
 }
 
+// defaultParallelism is how many services the scheduler creates/updates at
+// once when --parallel isn't given.
+const defaultParallelism = 4
+
 // Run must be implemented by any plugin because it is part of the
 // plugin interface defined by the core CLI.
 //
@@ -33,13 +56,60 @@ func (c *CreateServicePush) Run(cliConnection plugin.CliConnection, args []strin
 		return
 	}
 
+	// Following the Docker CLI plugin pattern, args[1] (when it is one of
+	// apply/plan/destroy/list) names the subcommand to run. Anything else in
+	// args[1] is left for apply. "apply" is the default, so
+	// `cf create-service-push` with no subcommand keeps its original meaning.
+	subcommand := "apply"
+	rest := args[1:]
+	if len(args) > 1 {
+		switch args[1] {
+		case "apply", "plan", "destroy", "list":
+			subcommand = args[1]
+			rest = args[2:]
+		}
+	}
+
+	switch subcommand {
+	case "plan":
+		c.runPlan(cliConnection, rest)
+	case "destroy":
+		c.runDestroy(cliConnection, rest)
+	case "list":
+		c.runList(cliConnection, rest)
+	default:
+		c.runApply(cliConnection, rest)
+	}
+}
+
+// runApply creates/updates the services declared in the manifest, pushes the
+// app, and binds the services to it. This is the plugin's original (and
+// still default) behaviour.
+func (c *CreateServicePush) runApply(cliConnection plugin.CliConnection, args []string) {
+	if err := c.doApply(cliConnection, args); err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// doApply is runApply's body. It returns an error instead of calling
+// os.Exit directly so that a restoreTarget deferred after a
+// --target-org/--target-space retarget always runs - even when a later step
+// fails - before runApply exits the process.
+func (c *CreateServicePush) doApply(cliConnection plugin.CliConnection, args []string) error {
+
 	// 1. Find an argument of --service-manifest in the list.  This will tell us the manifest file
 	var manifestFilename = "services-manifest.yml"
 	var pushApplication = true
+	var updateServices = false
+	var bindServices = true
+	var prune = false
+	var parallel = defaultParallelism
+	var targetOrg, targetSpace, stateFilePath string
 
 	for i, arg := range args {
 		if arg == "--service-manifest" {
-			manifestFilename = args[i+1]
+			manifestFilename = flagValueOrExit(args, i, arg)
 			break
 		} else if arg == "--no-service-manifest" {
 			manifestFilename = ""
@@ -47,44 +117,100 @@ func (c *CreateServicePush) Run(cliConnection plugin.CliConnection, args []strin
 		}
 	}
 	// Also check for other specific flags
-	for _, arg := range args {
-		if arg == "--no-push" {
+	for i, arg := range args {
+		switch arg {
+		case "--no-push":
 			pushApplication = false
-			break
+		case "--no-bind":
+			bindServices = false
+		case "--update-services":
+			updateServices = true
+		case "--prune":
+			prune = true
+		case "--target-org":
+			targetOrg = flagValueOrExit(args, i, arg)
+		case "--target-space":
+			targetSpace = flagValueOrExit(args, i, arg)
+		case "--state-file":
+			stateFilePath = flagValueOrExit(args, i, arg)
+		case "--parallel":
+			n, err := strconv.Atoi(flagValueOrExit(args, i, arg))
+			if err != nil {
+				return fmt.Errorf("--parallel must be a number: %s", err)
+			}
+			parallel = n
+		}
+	}
+
+	if stateFilePath == "" {
+		path, err := defaultStateFilePath()
+		if err != nil {
+			return err
 		}
+		stateFilePath = path
+	}
+
+	// 1a. Fail fast if the user isn't logged in.
+	if err := checkLoggedIn(cliConnection); err != nil {
+		return err
+	}
+
+	// 1b. If the user asked to pin execution to a specific org/space, retarget
+	// now (before the org/space check below) and restore the previous target
+	// once we're done. Every error path below this point must `return` (not
+	// os.Exit) so this defer actually runs.
+	if targetOrg != "" || targetSpace != "" {
+		restoreTarget, err := retargetOrgAndSpace(cliConnection, targetOrg, targetSpace)
+		if err != nil {
+			return err
+		}
+		defer restoreTarget()
+	}
+
+	// 1c. Now that any --target-org/--target-space has been applied, check
+	// that an org and space are actually targeted.
+	if err := checkTargeted(cliConnection); err != nil {
+		return err
+	}
+
+	target, err := resolveTargetKey(cliConnection)
+	if err != nil {
+		return err
 	}
 
 	// 2. Whatever the manifest file is, check to make sure it exists!
+	var createServicesobject *CreateServicePush
+	var succeededServices []string
 	if len(manifestFilename) > 0 {
-		if _, err := os.Stat(manifestFilename); !os.IsNotExist(err) {
-			fmt.Printf("Found ManifestFile: %s\n", manifestFilename)
-			filePointer, err := os.Open(manifestFilename)
-			if err == nil {
-				manifest, err := ParseManifest(filePointer)
-				if err != nil {
-					fmt.Printf("ERROR: %s\n", err)
-					os.Exit(1)
-				}
-
-				createServicesobject := &CreateServicePush{
-					manifest: &manifest,
-					cf:       cliConnection,
-				}
-				createServicesobject.createServices()
-			} else {
-				fmt.Printf("ERROR: Unable to open %s.\n", manifestFilename)
-				os.Exit(1)
-			}
-		} else {
-			fmt.Printf("ERROR: The file %s was not found.\n", manifestFilename)
-			os.Exit(1)
+		vars, err := varsFromArgs(args)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := loadManifest(manifestFilename, vars)
+		if err != nil {
+			return err
 		}
+		fmt.Printf("Found ManifestFile: %s\n", manifestFilename)
+
+		createServicesobject = &CreateServicePush{
+			manifest:       &manifest,
+			cf:             cliConnection,
+			updateServices: updateServices,
+			parallel:       parallel,
+			stateFilePath:  stateFilePath,
+			target:         target,
+		}
+
+		succeededServices = createServicesobject.createServices()
+		recordManagedServices(stateFilePath, target, manifest, succeededServices)
+		pruneUnmanagedServices(createServicesobject, stateFilePath, target, manifest, prune)
 	}
 
 	if pushApplication {
-		fmt.Printf("Performing a CF Push with arguments %s\n", strings.Join(args[1:], " "))
+		fmt.Printf("Performing a CF Push with arguments %s\n", strings.Join(args, " "))
 
-		newArgs := append([]string{"push"}, args[1:]...)
+		newArgs := append([]string{"push"}, args...)
 		// 3. Perform the cf push
 		output, err := cliConnection.CliCommand(newArgs...)
 		fmt.Printf("%s\n", output)
@@ -93,19 +219,589 @@ func (c *CreateServicePush) Run(cliConnection plugin.CliConnection, args []strin
 			fmt.Printf("ERROR while pushing: %s\n", err)
 		}
 	}
+
+	// 4. Bind the services we just created/updated to the pushed app (and to
+	// any app named explicitly under `bindings:`), restaging every app bound
+	// with -c parameters.
+	if bindServices && createServicesobject != nil {
+		pushedApp, err := pushedAppName(args)
+		if err != nil {
+			fmt.Printf("ERROR: unable to determine the app being pushed, skipping binding: %s\n", err)
+		} else {
+			createServicesobject.bindServices(pushedApp, succeededServices)
+		}
+	}
+
+	return nil
+}
+
+// runPlan loads the services manifest and prints what `apply` would do
+// (create/update/bind) without calling any mutating CF command. An existing
+// service is reported as unchanged unless --update-services or its
+// update_service field is set; drift that apply detects through the state
+// file's manifest hash is not reported. Only bind_to and `bindings:` entries
+// are listed as bindings; apply's default binding to the pushed app is not.
+func (c *CreateServicePush) runPlan(cliConnection plugin.CliConnection, args []string) {
+	if err := checkPreconditions(cliConnection); err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	manifestFilename := manifestFilenameFromArgs(args)
+
+	vars, err := varsFromArgs(args)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	manifest, err := loadManifest(manifestFilename, vars)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	updateServices := false
+	for _, arg := range args {
+		if arg == "--update-services" {
+			updateServices = true
+		}
+	}
+
+	planObject := &CreateServicePush{manifest: &manifest, cf: cliConnection, updateServices: updateServices}
+
+	existing, err := cliConnection.GetServices()
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	exists := map[string]bool{}
+	for _, svc := range existing {
+		exists[svc.Name] = true
+	}
+
+	for _, entry := range manifest.Services {
+		switch {
+		case exists[entry.ServiceName] && (planObject.updateServices || entry.UpdateService):
+			fmt.Printf("~ %s would be checked for drift and updated if its plan/parameters differ\n", entry.ServiceName)
+		case exists[entry.ServiceName]:
+			fmt.Printf("= %s already exists, no change\n", entry.ServiceName)
+		case entry.IsUserProvided():
+			fmt.Printf("+ %s would be created as a user-provided service\n", entry.ServiceName)
+		default:
+			fmt.Printf("+ %s would be created (%s/%s)\n", entry.ServiceName, entry.Broker, entry.PlanName)
+		}
+
+		for _, app := range entry.BindTo {
+			fmt.Printf("+ %s would be bound to %s\n", entry.ServiceName, app)
+		}
+	}
+
+	for _, binding := range manifest.Bindings {
+		for _, svc := range binding.Services {
+			fmt.Printf("+ %s would be bound to %s\n", svc.ServiceName, binding.App)
+		}
+	}
+}
+
+// runDestroy deletes every service declared in the manifest that the state
+// file records as managed by this plugin, waiting for each deletion to
+// complete. Manifest services not recorded as managed are skipped.
+func (c *CreateServicePush) runDestroy(cliConnection plugin.CliConnection, args []string) {
+	if err := checkPreconditions(cliConnection); err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	manifestFilename := manifestFilenameFromArgs(args)
+
+	vars, err := varsFromArgs(args)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	manifest, err := loadManifest(manifestFilename, vars)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	var stateFilePath string
+	for i, arg := range args {
+		if arg == "--state-file" {
+			stateFilePath = flagValueOrExit(args, i, arg)
+			break
+		}
+	}
+	if stateFilePath == "" {
+		path, err := defaultStateFilePath()
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		stateFilePath = path
+	}
+
+	target, err := resolveTargetKey(cliConnection)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	managed, err := managedServiceNames(stateFilePath, target)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	destroyObject := &CreateServicePush{manifest: &manifest, cf: cliConnection}
+	for _, entry := range manifest.Services {
+		if !managed[entry.ServiceName] {
+			fmt.Printf("%s is not recorded as managed by this plugin, skipping.\n", entry.ServiceName)
+			continue
+		}
+
+		if err := destroyObject.destroyService(entry.ServiceName); err != nil {
+			fmt.Printf("Destroy Service Error: %+v \n", err)
+			continue
+		}
+
+		if err := forgetManaged(stateFilePath, target, entry.ServiceName); err != nil {
+			fmt.Printf("ERROR: unable to update state file: %s\n", err)
+		}
+	}
 }
 
-func (c *CreateServicePush) createServices() error {
+// destroyService runs `cf delete-service -f NAME` and waits for the service
+// to disappear.
+func (c *CreateServicePush) destroyService(name string) error {
+	fmt.Printf("%s will now be deleted.\n", name)
+
+	if err := c.run("delete-service", "-f", name); err != nil {
+		return err
+	}
 
-	for _, serviceObject := range c.manifest.Services {
-		if err := c.createService(serviceObject.ServiceName, serviceObject.Broker, serviceObject.PlanName, serviceObject.JSONParameters); err != nil {
-			fmt.Printf("Create Service Error: %+v \n", err)
+	pb := NewLabeledProgressSpinner(os.Stdout, name)
+	defer pb.Done()
+	for {
+		service, err := c.cf.GetService(name)
+		if err != nil {
+			// GetService errors once the service instance is gone.
+			break
+		}
+
+		pb.Next(service.LastOperation.Description)
+
+		if service.LastOperation.State == "failed" {
+			return fmt.Errorf(
+				"error %s [status: %s]",
+				service.LastOperation.Description,
+				service.LastOperation.State,
+			)
 		}
 	}
 
 	return nil
 }
 
+// runList prints the current state of every service declared in the manifest.
+func (c *CreateServicePush) runList(cliConnection plugin.CliConnection, args []string) {
+	if err := checkPreconditions(cliConnection); err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	manifestFilename := manifestFilenameFromArgs(args)
+
+	vars, err := varsFromArgs(args)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	manifest, err := loadManifest(manifestFilename, vars)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	for _, entry := range manifest.Services {
+		service, err := cliConnection.GetService(entry.ServiceName)
+		if err != nil {
+			fmt.Printf("%s: not found\n", entry.ServiceName)
+			continue
+		}
+
+		fmt.Printf("%s: plan=%s state=%s\n", service.Name, service.ServicePlan.Name, service.LastOperation.State)
+	}
+}
+
+// flagValueOrExit returns args[i+1], the value following flag at index i.
+// Flags are parsed with simple `args[i+1]` lookups throughout this file;
+// this checks flag wasn't given as the last argument with no value after
+// it, so a missing value fails with a clear error instead of a slice-bounds
+// panic.
+func flagValueOrExit(args []string, i int, flag string) string {
+	if i+1 >= len(args) {
+		fmt.Printf("ERROR: %s requires a value\n", flag)
+		os.Exit(1)
+	}
+
+	return args[i+1]
+}
+
+// manifestFilenameFromArgs finds --service-manifest/--no-service-manifest in
+// args, defaulting to services-manifest.yml.
+func manifestFilenameFromArgs(args []string) string {
+	manifestFilename := "services-manifest.yml"
+
+	for i, arg := range args {
+		if arg == "--service-manifest" {
+			manifestFilename = flagValueOrExit(args, i, arg)
+			break
+		} else if arg == "--no-service-manifest" {
+			manifestFilename = ""
+			break
+		}
+	}
+
+	return manifestFilename
+}
+
+// loadManifest opens and parses the named services manifest file, resolving
+// `${VAR}`/`(( file ... ))` references against vars.
+func loadManifest(manifestFilename string, vars map[string]string) (Manifest, error) {
+	if manifestFilename == "" {
+		return Manifest{}, fmt.Errorf("no services manifest to load")
+	}
+
+	if _, err := os.Stat(manifestFilename); os.IsNotExist(err) {
+		return Manifest{}, fmt.Errorf("the file %s was not found", manifestFilename)
+	}
+
+	filePointer, err := os.Open(manifestFilename)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("unable to open %s: %s", manifestFilename, err)
+	}
+	defer filePointer.Close()
+
+	return ParseManifestWithVars(filePointer, vars)
+}
+
+// varsFromArgs collects variables passed via `--var KEY=VALUE` (repeatable)
+// and `--vars-file vars.yml` (a flat YAML map of key: value), for
+// interpolation into the services manifest. --var takes precedence over
+// --vars-file when both declare the same key.
+func varsFromArgs(args []string) (map[string]string, error) {
+	vars := map[string]string{}
+
+	for i, arg := range args {
+		if arg != "--vars-file" {
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("--vars-file requires a value")
+		}
+
+		data, err := ioutil.ReadFile(args[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("unable to read vars file %s: %s", args[i+1], err)
+		}
+
+		var fileVars map[string]string
+		if err := yaml.Unmarshal(data, &fileVars); err != nil {
+			return nil, fmt.Errorf("unable to parse vars file %s: %s", args[i+1], err)
+		}
+
+		for k, v := range fileVars {
+			vars[k] = v
+		}
+	}
+
+	for i, arg := range args {
+		if arg != "--var" {
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("--var requires a value")
+		}
+
+		kv := strings.SplitN(args[i+1], "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("--var must be given as KEY=VALUE, got %q", args[i+1])
+		}
+
+		vars[kv[0]] = kv[1]
+	}
+
+	return vars, nil
+}
+
+// cfAppManifest is the minimal shape we need out of a CF application
+// manifest (manifest.yml) in order to default binding to the app being pushed.
+type cfAppManifest struct {
+	Applications []struct {
+		Name string `yaml:"name"`
+	} `yaml:"applications"`
+}
+
+// noValueFlags are every flag pushedAppName can encounter in args that takes
+// no value - this plugin's own boolean flags plus the handful of `cf push`
+// boolean flags callers are likely to pass through - so it never mistakes
+// the token following one of them for the positional app name.
+var noValueFlags = map[string]bool{
+	"--no-push":             true,
+	"--no-bind":             true,
+	"--no-service-manifest": true,
+	"--update-services":     true,
+	"--prune":               true,
+	"--no-route":            true,
+	"--random-route":        true,
+	"--no-start":            true,
+}
+
+// pushedAppName determines the name of the app `cf push` is about to push:
+// the first positional (non-flag) argument if one was given on the command
+// line, otherwise the first application's name in manifest.yml.
+func pushedAppName(pushArgs []string) (string, error) {
+	for i := 0; i < len(pushArgs); i++ {
+		arg := pushArgs[i]
+		if !strings.HasPrefix(arg, "-") {
+			return arg, nil
+		}
+		// Flags that take a value consume the next argument too, so it isn't
+		// mistaken for the app name.
+		if !noValueFlags[arg] {
+			i++
+		}
+	}
+
+	data, err := ioutil.ReadFile("manifest.yml")
+	if err != nil {
+		return "", fmt.Errorf("no app name given and unable to read manifest.yml: %s", err)
+	}
+
+	var appManifest cfAppManifest
+	if err := yaml.Unmarshal(data, &appManifest); err != nil {
+		return "", err
+	}
+
+	if len(appManifest.Applications) == 0 || appManifest.Applications[0].Name == "" {
+		return "", fmt.Errorf("manifest.yml does not declare an application name")
+	}
+
+	return appManifest.Applications[0].Name, nil
+}
+
+// checkPreconditions verifies the user is logged in and has an org/space
+// targeted before the plugin touches anything. Callers that retarget the
+// org/space (apply's --target-org/--target-space) should call checkLoggedIn
+// and checkTargeted separately around the retarget instead, since the
+// org/space check only makes sense once any retargeting has happened.
+func checkPreconditions(cliConnection plugin.CliConnection) error {
+	if err := checkLoggedIn(cliConnection); err != nil {
+		return err
+	}
+
+	return checkTargeted(cliConnection)
+}
+
+// checkLoggedIn verifies the user is logged in.
+func checkLoggedIn(cliConnection plugin.CliConnection) error {
+	loggedIn, err := cliConnection.IsLoggedIn()
+	if err != nil {
+		return err
+	}
+	if !loggedIn {
+		return fmt.Errorf("you are not logged in. Run 'cf login' and try again")
+	}
+
+	return nil
+}
+
+// checkTargeted verifies the user has an org and space targeted, printing
+// the resolved target so the user can confirm where services are about to
+// be created.
+func checkTargeted(cliConnection plugin.CliConnection) error {
+	hasOrg, err := cliConnection.HasOrganization()
+	if err != nil {
+		return err
+	}
+	if !hasOrg {
+		return fmt.Errorf("no org targeted. Run 'cf target -o ORG' and try again")
+	}
+
+	hasSpace, err := cliConnection.HasSpace()
+	if err != nil {
+		return err
+	}
+	if !hasSpace {
+		return fmt.Errorf("no space targeted. Run 'cf target -o ORG -s SPACE' and try again")
+	}
+
+	org, err := cliConnection.GetCurrentOrg()
+	if err != nil {
+		return err
+	}
+
+	space, err := cliConnection.GetCurrentSpace()
+	if err != nil {
+		return err
+	}
+
+	apiEndpoint, err := cliConnection.ApiEndpoint()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Targeting org %s / space %s on %s\n", org.Name, space.Name, apiEndpoint)
+
+	return nil
+}
+
+// retargetOrgAndSpace runs `cf target -o/-s` against org/space (whichever are
+// non-empty) and returns a function that restores the previously targeted
+// org/space. Call the returned function (typically via defer) once the
+// plugin is done so the user's shell is left targeted where it started.
+func retargetOrgAndSpace(cliConnection plugin.CliConnection, org, space string) (func(), error) {
+	prevOrg, err := cliConnection.GetCurrentOrg()
+	if err != nil {
+		return nil, err
+	}
+
+	prevSpace, err := cliConnection.GetCurrentSpace()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := targetOrgAndSpace(cliConnection, org, space); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := targetOrgAndSpace(cliConnection, prevOrg.Name, prevSpace.Name); err != nil {
+			fmt.Printf("ERROR: unable to restore previous target (org %s / space %s): %s\n", prevOrg.Name, prevSpace.Name, err)
+		}
+	}, nil
+}
+
+// targetOrgAndSpace runs `cf target -o ORG -s SPACE`, omitting either flag
+// when its value is empty.
+func targetOrgAndSpace(cliConnection plugin.CliConnection, org, space string) error {
+	args := []string{"target"}
+	if org != "" {
+		args = append(args, "-o", org)
+	}
+	if space != "" {
+		args = append(args, "-s", space)
+	}
+
+	_, err := cliConnection.CliCommand(args...)
+	return err
+}
+
+// resolveTargetKey builds the state file target key identifying the current
+// api endpoint/org/space.
+func resolveTargetKey(cliConnection plugin.CliConnection) (string, error) {
+	apiEndpoint, err := cliConnection.ApiEndpoint()
+	if err != nil {
+		return "", err
+	}
+
+	org, err := cliConnection.GetCurrentOrg()
+	if err != nil {
+		return "", err
+	}
+
+	space, err := cliConnection.GetCurrentSpace()
+	if err != nil {
+		return "", err
+	}
+
+	return targetKey(apiEndpoint, org.Guid, space.Guid), nil
+}
+
+// recordManagedServices marks every successfully created/updated service as
+// managed by this plugin in the state file, so later `apply --prune` and
+// `destroy` runs know it's safe to touch.
+func recordManagedServices(stateFilePath, target string, manifest Manifest, succeeded []string) {
+	byName := map[string]ServiceManifestEntry{}
+	for _, entry := range manifest.Services {
+		byName[entry.ServiceName] = entry
+	}
+
+	for _, name := range succeeded {
+		if err := recordManaged(stateFilePath, target, name, byName[name]); err != nil {
+			fmt.Printf("ERROR: unable to update state file for %s: %s\n", name, err)
+		}
+	}
+}
+
+// pruneUnmanagedServices finds services recorded as plugin-managed for target
+// that are no longer declared in manifest. When prune is true they're
+// deleted and forgotten; otherwise they're just reported.
+func pruneUnmanagedServices(c *CreateServicePush, stateFilePath, target string, manifest Manifest, prune bool) {
+	managed, err := managedServiceNames(stateFilePath, target)
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		return
+	}
+
+	declared := map[string]bool{}
+	for _, entry := range manifest.Services {
+		declared[entry.ServiceName] = true
+	}
+
+	for name := range managed {
+		if declared[name] {
+			continue
+		}
+
+		if !prune {
+			fmt.Printf("%s is no longer declared in the manifest but is still managed by this plugin. Run with --prune to delete it.\n", name)
+			continue
+		}
+
+		if err := c.destroyService(name); err != nil {
+			fmt.Printf("Destroy Service Error: %+v \n", err)
+			continue
+		}
+
+		if err := forgetManaged(stateFilePath, target, name); err != nil {
+			fmt.Printf("ERROR: unable to update state file: %s\n", err)
+		}
+	}
+}
+
+// createServices creates/updates every manifest service, dispatching them to
+// a worker pool (size c.parallel, defaulting to defaultParallelism) that
+// honors each entry's depends_on. It returns the names of every service that
+// converged successfully.
+func (c *CreateServicePush) createServices() []string {
+	parallel := c.parallel
+	if parallel == 0 {
+		parallel = defaultParallelism
+	}
+
+	out := c.out
+	if out == nil {
+		out = os.Stdout
+	}
+	spinnerOut := newSerializedWriter(out)
+	defer spinnerOut.Close()
+
+	scoped := *c
+	scoped.out = spinnerOut
+	// The scheduler's worker pool calls into c.cf concurrently; the
+	// underlying CliConnection RPC implementation isn't safe for that, so
+	// every worker shares one synchronizedCliConnection instead.
+	scoped.cf = &synchronizedCliConnection{CliConnection: c.cf, mu: &sync.Mutex{}}
+
+	return newServiceScheduler(&scoped, c.manifest.Services, parallel).run()
+}
+
 func (c *CreateServicePush) run(args ...string) error {
 	if os.Getenv("DEBUG") != "" {
 		fmt.Printf(">> %s\n", strings.Join(args, " "))
@@ -116,7 +812,9 @@ func (c *CreateServicePush) run(args ...string) error {
 	return err
 }
 
-func (c *CreateServicePush) createService(name, broker, plan, JSONParam string) error {
+func (c *CreateServicePush) createService(entry ServiceManifestEntry) error {
+	name, broker, plan, JSONParam := entry.ServiceName, entry.Broker, entry.PlanName, entry.JSONParameters
+
 	s, err := c.cf.GetServices()
 	if err != nil {
 		return err
@@ -124,6 +822,9 @@ func (c *CreateServicePush) createService(name, broker, plan, JSONParam string)
 
 	for _, svc := range s {
 		if svc.Name == name {
+			if c.updateServices || entry.UpdateService || manifestHashChanged(c.stateFilePath, c.target, entry) {
+				return c.updateServiceIfDrifted(entry)
+			}
 			fmt.Printf("%s already exists.\n", name)
 			return nil
 		}
@@ -142,7 +843,54 @@ func (c *CreateServicePush) createService(name, broker, plan, JSONParam string)
 		return result
 	}
 
-	pb := NewProgressSpinner(os.Stdout)
+	return c.waitForServiceOperation(name)
+}
+
+// updateServiceIfDrifted compares the manifest's declared plan against the
+// service's current plan (fetched via GetService) and runs
+// `cf update-service` if they've drifted. It also runs `cf service NAME`, but
+// its output is not compared against anything.
+// CF does not expose a service instance's currently-applied -c parameters for
+// comparison, so declared JSON parameters are always reapplied.
+func (c *CreateServicePush) updateServiceIfDrifted(entry ServiceManifestEntry) error {
+	service, err := c.cf.GetService(entry.ServiceName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.cf.CliCommandWithoutTerminalOutput("service", entry.ServiceName); err != nil {
+		return err
+	}
+
+	planDrifted := service.ServicePlan.Name != entry.PlanName
+	if !planDrifted && entry.JSONParameters == "" {
+		fmt.Printf("%s already exists and matches the manifest, skipping update.\n", entry.ServiceName)
+		return nil
+	}
+
+	fmt.Printf("%s already exists and has drifted from the manifest, updating it.\n", entry.ServiceName)
+
+	args := []string{"update-service", entry.ServiceName, "-p", entry.PlanName}
+	if entry.JSONParameters != "" {
+		args = append(args, "-c", entry.JSONParameters)
+	}
+
+	if err := c.run(args...); err != nil {
+		return fmt.Errorf("error updating %s: %s", entry.ServiceName, err)
+	}
+
+	return c.waitForServiceOperation(entry.ServiceName)
+}
+
+// waitForServiceOperation polls GetService(name) until its LastOperation
+// settles, printing progress via a ProgressSpinner.
+func (c *CreateServicePush) waitForServiceOperation(name string) error {
+	out := c.out
+	if out == nil {
+		out = os.Stdout
+	}
+	pb := NewLabeledProgressSpinner(out, name)
+	defer pb.Done()
 	for {
 		service, err := c.cf.GetService(name)
 		if err != nil {
@@ -166,6 +914,148 @@ func (c *CreateServicePush) createService(name, broker, plan, JSONParam string)
 	return nil
 }
 
+// createUserProvidedService creates (or, if it already exists with different
+// credentials, updates) a user-provided service declared in the manifest via
+// `cf cups`/`cf uups` instead of a broker-based `cf create-service`. CF does
+// not expose a user-provided service's currently-applied credentials for
+// comparison, so - like createService's update path - drift is detected via
+// manifestHashChanged instead; an existing service whose hash hasn't changed
+// since this plugin last applied it is left alone.
+func (c *CreateServicePush) createUserProvidedService(entry ServiceManifestEntry) error {
+	credentials, err := resolveCredentials(entry)
+	if err != nil {
+		return err
+	}
+
+	s, err := c.cf.GetServices()
+	if err != nil {
+		return err
+	}
+
+	exists := false
+	for _, svc := range s {
+		if svc.Name == entry.ServiceName {
+			exists = true
+			break
+		}
+	}
+
+	if exists && !manifestHashChanged(c.stateFilePath, c.target, entry) {
+		fmt.Printf("%s already exists and matches the manifest, skipping update.\n", entry.ServiceName)
+		return nil
+	}
+
+	cmd := "cups"
+	if exists {
+		cmd = "uups"
+	}
+
+	args := []string{cmd, entry.ServiceName}
+	if credentials != "" {
+		args = append(args, "-p", credentials)
+	}
+	if entry.SyslogDrainURL != "" {
+		args = append(args, "-l", entry.SyslogDrainURL)
+	}
+	if entry.RouteServiceURL != "" {
+		args = append(args, "-r", entry.RouteServiceURL)
+	}
+
+	if exists {
+		fmt.Printf("%s already exists as a user-provided service, updating it.\n", entry.ServiceName)
+	} else {
+		fmt.Printf("%s will now be created as a user-provided service.\n", entry.ServiceName)
+	}
+
+	return c.run(args...)
+}
+
+// resolveCredentials returns the inline JSON credentials for a user-provided
+// service entry, reading them from CredentialsFile when one is given.
+func resolveCredentials(entry ServiceManifestEntry) (string, error) {
+	if entry.CredentialsFile == "" {
+		return entry.Credentials, nil
+	}
+
+	data, err := ioutil.ReadFile(entry.CredentialsFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read credentials_file %s: %s", entry.CredentialsFile, err)
+	}
+
+	return string(data), nil
+}
+
+// bindServices binds every manifest service that actually converged (see
+// succeeded) to its declared bind_to apps (defaulting to pushedApp when none
+// are declared), then binds every service named under the top level
+// `bindings:` section - which may name services this plugin doesn't manage
+// at all, so it isn't filtered by succeeded - restaging every app that was
+// bound with -c parameters so it picks them up. Whether those parameters
+// differ from an existing binding's is not checked.
+func (c *CreateServicePush) bindServices(pushedApp string, succeeded []string) error {
+	succeededNames := map[string]bool{}
+	for _, name := range succeeded {
+		succeededNames[name] = true
+	}
+
+	restage := map[string]bool{}
+
+	for _, entry := range c.manifest.Services {
+		if !succeededNames[entry.ServiceName] {
+			fmt.Printf("%s did not converge, skipping bind.\n", entry.ServiceName)
+			continue
+		}
+
+		apps := entry.BindTo
+		if len(apps) == 0 {
+			if pushedApp == "" {
+				continue
+			}
+			apps = []string{pushedApp}
+		}
+
+		for _, app := range apps {
+			if c.bindService(app, entry.ServiceName, "") {
+				restage[app] = true
+			}
+		}
+	}
+
+	for _, binding := range c.manifest.Bindings {
+		for _, svc := range binding.Services {
+			if c.bindService(binding.App, svc.ServiceName, svc.JSONParameters) {
+				restage[binding.App] = true
+			}
+		}
+	}
+
+	for app := range restage {
+		fmt.Printf("Restaging %s to pick up binding parameter changes.\n", app)
+		if err := c.run("restage", app); err != nil {
+			fmt.Printf("Restage Error: %+v \n", err)
+		}
+	}
+
+	return nil
+}
+
+// bindService runs `cf bind-service APP SERVICE [-c JSON]`, reporting the
+// error (if any) and returning whether JSON parameters were supplied, which
+// means APP needs restaging to pick them up.
+func (c *CreateServicePush) bindService(app, service, JSONParam string) bool {
+	args := []string{"bind-service", app, service}
+	if JSONParam != "" {
+		args = append(args, "-c", JSONParam)
+	}
+
+	if err := c.run(args...); err != nil {
+		fmt.Printf("Bind Service Error: %+v \n", err)
+		return false
+	}
+
+	return JSONParam != ""
+}
+
 // GetMetadata must be implemented as part of the plugin interface
 // defined by the core CLI.
 //
@@ -199,11 +1089,24 @@ func (c *CreateServicePush) GetMetadata() plugin.PluginMetadata {
 				// UsageDetails is optional
 				// It is used to show help of usage of each command
 				UsageDetails: plugin.Usage{
-					Usage: "create-service-push\n   cf create-service-push",
+					Usage: "create-service-push [apply|plan|destroy|list]\n   cf create-service-push\n   cf create-service-push plan\n   cf create-service-push destroy\n   cf create-service-push list",
 					Options: map[string]string{
+						"apply":                              "(default) Create/update the services declared in the manifest, push the app, and bind them to it.",
+						"plan":                               "Dry run: print what apply would create/update/bind without changing anything in CF.",
+						"destroy":                            "Delete every service declared in the manifest that this plugin's state file records as managed.",
+						"list":                               "Show the current state of every service declared in the manifest.",
 						"--service-manifest <MANIFEST_FILE>": "Specify the fullpath and filename of the services creation manifest.  Defaults to services-manifest.yml.",
 						"--no-service-manifest":              "Specifies that there is no service creation manifest",
-						"--no-push":                          "Create the services but do not push the application",
+						"--no-push":                          "Create the services but do not push the application (apply only)",
+						"--target-org <ORG>":                 "Target the given org before creating services, restoring the previous target on exit.",
+						"--target-space <SPACE>":             "Target the given space before creating services, restoring the previous target on exit.",
+						"--update-services":                  "Update existing services whose plan or parameters have drifted from the manifest, instead of skipping them.",
+						"--no-bind":                          "Create/update the services but do not bind them to any app (apply only)",
+						"--var <KEY=VALUE>":                  "Set a variable for ${KEY} interpolation in the services manifest. Repeatable.",
+						"--vars-file <FILE>":                  "Load variables for ${KEY} interpolation from a flat key: value YAML file.",
+						"--parallel <N>":                      "Create/update up to N services concurrently, honoring depends_on. Defaults to 4.",
+						"--state-file <PATH>":                 "Path to the state file tracking plugin-managed services. Defaults to ~/.cf/plugins/create-service-push/state.json.",
+						"--prune":                             "On apply, delete services that are recorded as plugin-managed but no longer declared in the manifest (apply only).",
 					},
 				},
 			},
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Manifest represents the top level structure of a services-manifest.yml file.
+type Manifest struct {
+	Services []ServiceManifestEntry `yaml:"create-services"`
+	Bindings []Binding              `yaml:"bindings"`
+}
+
+// Binding declares that a set of services should be bound to App, as
+// expressed under the top level `bindings:` key of a services-manifest.yml
+// file. This is the place to bind a service to an app other than the one
+// being pushed.
+type Binding struct {
+	App      string           `yaml:"app"`
+	Services []ServiceBinding `yaml:"services"`
+}
+
+// ServiceBinding names a service to bind to a Binding's app, with optional
+// JSON parameters to pass to `cf bind-service -c`.
+type ServiceBinding struct {
+	ServiceName    string `yaml:"service"`
+	JSONParameters string `yaml:"parameters"`
+}
+
+// ServiceManifestEntry describes a single service to be created, as declared
+// under the `create-services:` key of a services-manifest.yml file.
+type ServiceManifestEntry struct {
+	ServiceName    string `yaml:"name"`
+	Broker         string `yaml:"broker"`
+	PlanName       string `yaml:"plan"`
+	JSONParameters string `yaml:"parameters"`
+
+	// Type, when set to "user-provided", marks this entry as a user-provided
+	// service created via `cf cups` instead of a broker-based `cf create-service`.
+	Type string `yaml:"type"`
+
+	// Credentials is an inline JSON object of credentials for a user-provided
+	// service. CredentialsFile, if set, is a path to a file containing the
+	// same and takes precedence over Credentials.
+	Credentials     string `yaml:"credentials"`
+	CredentialsFile string `yaml:"credentials_file"`
+
+	SyslogDrainURL  string `yaml:"syslog_drain_url"`
+	RouteServiceURL string `yaml:"route_service_url"`
+
+	// UpdateService opts this entry into update-if-exists reconciliation: if
+	// the service already exists, its plan/parameters are compared against
+	// this entry and `cf update-service` is run when they've drifted, instead
+	// of the entry being silently skipped.
+	UpdateService bool `yaml:"update_service"`
+
+	// BindTo lists app names this service should be bound to once it is
+	// created/updated. When empty, it is bound to the app being pushed.
+	BindTo []string `yaml:"bind_to"`
+
+	// DependsOn names other manifest services that must finish (successfully)
+	// before this one is started, letting the scheduler parallelize everything
+	// that isn't on a dependency chain.
+	DependsOn []string `yaml:"depends_on"`
+}
+
+// IsUserProvided reports whether this entry declares a user-provided service
+// rather than a broker-based one.
+func (s ServiceManifestEntry) IsUserProvided() bool {
+	return s.Type == "user-provided"
+}
+
+// ParseManifest reads a services-manifest.yml from r and unmarshals it into
+// a Manifest.
+func ParseManifest(r io.Reader) (Manifest, error) {
+	return ParseManifestWithVars(r, nil)
+}
+
+// ParseManifestWithVars reads a services-manifest.yml from r, interpolating
+// `${VAR}` / `${VAR:-default}` references (resolved from vars, falling back
+// to the process environment) and `(( file "path" ))` references (replaced
+// with the named file's contents) before unmarshalling it into a Manifest.
+func ParseManifestWithVars(r io.Reader, vars map[string]string) (Manifest, error) {
+	var manifest Manifest
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return manifest, err
+	}
+
+	interpolated, err := interpolateManifest(data, vars)
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := yaml.Unmarshal(interpolated, &manifest); err != nil {
+		return manifest, err
+	}
+
+	return manifest, nil
+}
+
+var (
+	fileInterpolationPattern   = regexp.MustCompile(`\(\(\s*file\s+"([^"]+)"\s*\)\)`)
+	envVarInterpolationPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+)
+
+// interpolateManifest resolves `(( file "path" ))` and `${VAR}` / `${VAR:-default}`
+// references in a raw services-manifest.yml, in that order.
+func interpolateManifest(data []byte, vars map[string]string) ([]byte, error) {
+	withFiles, err := interpolateFiles(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, unresolved := interpolateEnvVars(withFiles, vars)
+	if len(unresolved) > 0 {
+		return nil, fmt.Errorf("unresolved variables in services manifest: %s", strings.Join(unresolved, ", "))
+	}
+
+	return []byte(resolved), nil
+}
+
+// interpolateFiles replaces every `(( file "path" ))` token with the
+// contents of the named file, quoted as a YAML double-quoted scalar so a
+// file holding a JSON/YAML blob (the main reason to use `(( file ... ))`:
+// keeping a large `-c` parameters payload out of the manifest) lands in the
+// manifest as the string it's declared to be, not as its own parsed node.
+func interpolateFiles(text string) (string, error) {
+	var readErr error
+
+	result := fileInterpolationPattern.ReplaceAllStringFunc(text, func(match string) string {
+		path := fileInterpolationPattern.FindStringSubmatch(match)[1]
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			readErr = fmt.Errorf("unable to read file %q: %s", path, err)
+			return match
+		}
+
+		quoted, err := json.Marshal(string(data))
+		if err != nil {
+			readErr = fmt.Errorf("unable to quote contents of file %q: %s", path, err)
+			return match
+		}
+
+		return string(quoted)
+	})
+
+	if readErr != nil {
+		return "", readErr
+	}
+
+	return result, nil
+}
+
+// interpolateEnvVars replaces every `${VAR}` / `${VAR:-default}` token,
+// resolving VAR from vars first, then the process environment, then the
+// given default. Any VAR left unresolved is returned in the unresolved slice.
+func interpolateEnvVars(text string, vars map[string]string) (string, []string) {
+	var unresolved []string
+
+	result := envVarInterpolationPattern.ReplaceAllStringFunc(text, func(match string) string {
+		groups := envVarInterpolationPattern.FindStringSubmatch(match)
+		name, defaultClause := groups[1], groups[2]
+
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		if defaultClause != "" {
+			return strings.TrimPrefix(defaultClause, ":-")
+		}
+
+		unresolved = append(unresolved, name)
+		return match
+	})
+
+	return result, unresolved
+}
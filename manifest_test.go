@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateFilesQuotesJSONBlob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "params.json")
+	if err := ioutil.WriteFile(path, []byte(`{"key": "value"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifestYAML := "create-services:\n" +
+		"- name: svc\n" +
+		"  broker: broker\n" +
+		"  plan: plan\n" +
+		"  parameters: (( file \"" + path + "\" ))\n"
+
+	manifest, err := ParseManifest(strings.NewReader(manifestYAML))
+	if err != nil {
+		t.Fatalf("ParseManifest returned an error: %s", err)
+	}
+
+	if len(manifest.Services) != 1 {
+		t.Fatalf("expected 1 service, got %d", len(manifest.Services))
+	}
+
+	if manifest.Services[0].JSONParameters != `{"key": "value"}` {
+		t.Fatalf("expected the file's contents to be interpolated verbatim, got %q", manifest.Services[0].JSONParameters)
+	}
+}
+
+func TestInterpolateEnvVarsUsesVarsThenEnvThenDefault(t *testing.T) {
+	os.Setenv("CSP_TEST_FROM_ENV", "env-value")
+	defer os.Unsetenv("CSP_TEST_FROM_ENV")
+
+	result, unresolved := interpolateEnvVars(
+		"${FROM_VARS} ${CSP_TEST_FROM_ENV} ${WITH_DEFAULT:-fallback}",
+		map[string]string{"FROM_VARS": "vars-value"},
+	)
+
+	if len(unresolved) != 0 {
+		t.Fatalf("expected everything to resolve, got unresolved: %v", unresolved)
+	}
+
+	if result != "vars-value env-value fallback" {
+		t.Fatalf("unexpected interpolation result: %q", result)
+	}
+}
+
+func TestInterpolateEnvVarsReportsUnresolved(t *testing.T) {
+	_, unresolved := interpolateEnvVars("${MISSING}", nil)
+
+	if len(unresolved) != 1 || unresolved[0] != "MISSING" {
+		t.Fatalf("expected MISSING to be reported unresolved, got %v", unresolved)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// ProgressSpinner prints a rotating spinner alongside a status message so
+// that the user gets feedback while the plugin polls a long running CF
+// operation (e.g. waiting on a service's LastOperation to settle).
+type ProgressSpinner struct {
+	out     io.Writer
+	label   string
+	frames  []string
+	current int
+}
+
+// NewProgressSpinner creates a ProgressSpinner that writes to out.
+func NewProgressSpinner(out io.Writer) *ProgressSpinner {
+	return NewLabeledProgressSpinner(out, "")
+}
+
+// NewLabeledProgressSpinner creates a ProgressSpinner that prefixes every
+// line with label. When several spinners share one out concurrently (see
+// serializedWriter), the label is what keeps each service's progress on a
+// line the user can tell apart from the others, rather than every write
+// landing on the same "\r"-addressed line.
+func NewLabeledProgressSpinner(out io.Writer, label string) *ProgressSpinner {
+	return &ProgressSpinner{
+		out:    out,
+		label:  label,
+		frames: []string{"|", "/", "-", "\\"},
+	}
+}
+
+// Next advances the spinner by one frame and prints it alongside message.
+func (p *ProgressSpinner) Next(message string) {
+	if p.label == "" {
+		fmt.Fprintf(p.out, "\r%s %s", p.frames[p.current%len(p.frames)], message)
+	} else {
+		// Each service gets its own line instead of sharing one "\r"-addressed
+		// line, so concurrent services' progress stays legible side by side.
+		fmt.Fprintf(p.out, "%s %s: %s\n", p.frames[p.current%len(p.frames)], p.label, message)
+	}
+	p.current++
+}
+
+// Done prints a trailing blank line once a labeled spinner's work is
+// finished, separating its lines (each already newline-terminated) from
+// whatever writes to out next. It is a no-op for an unlabeled spinner, which
+// never shares out with another spinner.
+func (p *ProgressSpinner) Done() {
+	if p.label != "" {
+		fmt.Fprintln(p.out)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"code.cloudfoundry.org/cli/plugin"
+	plugin_models "code.cloudfoundry.org/cli/plugin/models"
+)
+
+// serviceScheduler creates/updates every manifest service using a bounded
+// worker pool, honoring each entry's depends_on so that a service only
+// starts once every service it depends on has succeeded. This turns the
+// previous strictly-sequential loop into a DAG-driven parallel one.
+type serviceScheduler struct {
+	push     *CreateServicePush
+	parallel int
+
+	byName     map[string]ServiceManifestEntry
+	remaining  map[string]int
+	dependents map[string][]string
+
+	mu        sync.Mutex
+	failed    map[string]bool
+	succeeded []string
+	cancelled bool
+}
+
+// newServiceScheduler builds the dependency graph for entries. parallel is
+// clamped to at least 1.
+func newServiceScheduler(push *CreateServicePush, entries []ServiceManifestEntry, parallel int) *serviceScheduler {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	s := &serviceScheduler{
+		push:       push,
+		parallel:   parallel,
+		byName:     map[string]ServiceManifestEntry{},
+		remaining:  map[string]int{},
+		dependents: map[string][]string{},
+		failed:     map[string]bool{},
+	}
+
+	for _, entry := range entries {
+		s.byName[entry.ServiceName] = entry
+		s.remaining[entry.ServiceName] = len(entry.DependsOn)
+	}
+
+	for _, entry := range entries {
+		for _, dep := range entry.DependsOn {
+			s.dependents[dep] = append(s.dependents[dep], entry.ServiceName)
+		}
+	}
+
+	s.validate()
+
+	return s
+}
+
+// validate removes every entry that can never become ready - because it
+// depends on a name the manifest doesn't declare, or because it's part of a
+// depends_on cycle - and reports why. Without this, such entries would sit
+// in s.remaining forever: never scheduled, never marked failed, never
+// mentioned in the output.
+func (s *serviceScheduler) validate() {
+	original := map[string]ServiceManifestEntry{}
+	for name, entry := range s.byName {
+		original[name] = entry
+	}
+
+	remaining := map[string]int{}
+	for name, n := range s.remaining {
+		remaining[name] = n
+	}
+
+	var queue []string
+	for name, n := range remaining {
+		if n == 0 {
+			queue = append(queue, name)
+		}
+	}
+
+	resolved := map[string]bool{}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		resolved[name] = true
+
+		for _, dependent := range s.dependents[name] {
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				queue = append(queue, dependent)
+			}
+		}
+	}
+
+	// unknownDepRoot[name] is the unknown service name at the root of why name
+	// can never become ready, so an entry that only transitively depends on a
+	// bad reference (rather than naming one itself) is still reported
+	// accurately instead of being lumped in with genuine depends_on cycles.
+	unknownDepRoot := map[string]string{}
+	for name, entry := range original {
+		if resolved[name] {
+			continue
+		}
+		for _, dep := range entry.DependsOn {
+			if _, ok := original[dep]; !ok {
+				unknownDepRoot[name] = dep
+				break
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for name, entry := range original {
+			if resolved[name] || unknownDepRoot[name] != "" {
+				continue
+			}
+			for _, dep := range entry.DependsOn {
+				if root, ok := unknownDepRoot[dep]; ok {
+					unknownDepRoot[name] = root
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	for name := range original {
+		if resolved[name] {
+			continue
+		}
+
+		if root, ok := unknownDepRoot[name]; ok {
+			fmt.Printf("%s depends (directly or transitively) on %q, which is not declared in the manifest; skipping it.\n", name, root)
+		} else {
+			fmt.Printf("%s is part of a depends_on cycle; skipping it.\n", name)
+		}
+
+		delete(s.byName, name)
+		delete(s.remaining, name)
+		delete(s.dependents, name)
+		s.failed[name] = true
+	}
+}
+
+// run dispatches every entry to the worker pool in dependency order, blocks
+// until the whole graph has drained, and returns the names of every service
+// that was created/updated successfully.
+func (s *serviceScheduler) run() []string {
+	ready := make(chan string, len(s.byName))
+	var pending sync.WaitGroup
+
+	for name, deps := range s.remaining {
+		if deps == 0 {
+			pending.Add(1)
+			ready <- name
+		}
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < s.parallel; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for name := range ready {
+				s.process(name, ready, &pending)
+				pending.Done()
+			}
+		}()
+	}
+
+	pending.Wait()
+	close(ready)
+	workers.Wait()
+
+	return s.succeeded
+}
+
+// process creates/updates a single entry, then releases any dependent whose
+// last outstanding dependency just cleared. A failure marks the graph
+// cancelled: nodes not yet started are skipped, but nodes already in flight
+// are left to drain.
+func (s *serviceScheduler) process(name string, ready chan<- string, pending *sync.WaitGroup) {
+	entry := s.byName[name]
+
+	s.mu.Lock()
+	skip := s.cancelled
+	for _, dep := range entry.DependsOn {
+		if s.failed[dep] {
+			skip = true
+		}
+	}
+	s.mu.Unlock()
+
+	ok := !skip
+	if skip {
+		fmt.Printf("%s skipped: a prior service in the dependency graph failed.\n", name)
+	} else {
+		var err error
+		if entry.IsUserProvided() {
+			err = s.push.createUserProvidedService(entry)
+		} else {
+			err = s.push.createService(entry)
+		}
+
+		if err != nil {
+			fmt.Printf("Create Service Error: %+v \n", err)
+			ok = false
+		}
+	}
+
+	s.mu.Lock()
+	if !ok {
+		s.failed[name] = true
+		s.cancelled = true
+	} else {
+		s.succeeded = append(s.succeeded, name)
+	}
+	for _, dependent := range s.dependents[name] {
+		s.remaining[dependent]--
+		if s.remaining[dependent] == 0 {
+			pending.Add(1)
+			ready <- dependent
+		}
+	}
+	s.mu.Unlock()
+}
+
+// serializedWriter forwards writes to out through a single goroutine, so
+// concurrent workers polling different services' LastOperation don't
+// interleave their progress-spinner output.
+type serializedWriter struct {
+	lines chan []byte
+	done  chan struct{}
+}
+
+// newSerializedWriter starts the background goroutine that drains writes to out.
+func newSerializedWriter(out io.Writer) *serializedWriter {
+	w := &serializedWriter{
+		lines: make(chan []byte, 64),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		for line := range w.lines {
+			out.Write(line)
+		}
+		close(w.done)
+	}()
+
+	return w
+}
+
+func (w *serializedWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+	w.lines <- line
+	return len(p), nil
+}
+
+// Close stops accepting writes and waits for the background goroutine to
+// drain everything already queued.
+func (w *serializedWriter) Close() {
+	close(w.lines)
+	<-w.done
+}
+
+// synchronizedCliConnection serializes every RPC round trip made through a
+// shared plugin.CliConnection. The real CLI plugin RPC implementation
+// (code.cloudfoundry.org/cli/plugin/rpc.CliRpcCmd) runs CliCommand as
+// DisableTerminalOutput -> CallCoreCommand -> GetOutputAndReset against one
+// shared, unlocked outputBucket, so two goroutines calling it at once can
+// interleave those steps and corrupt or misattribute each other's output.
+// Locking is held only around each individual call, not across a caller's
+// polling loop, so unrelated workers can still interleave between polls.
+type synchronizedCliConnection struct {
+	plugin.CliConnection
+	mu *sync.Mutex
+}
+
+func (s *synchronizedCliConnection) CliCommand(args ...string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.CliConnection.CliCommand(args...)
+}
+
+func (s *synchronizedCliConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.CliConnection.CliCommandWithoutTerminalOutput(args...)
+}
+
+func (s *synchronizedCliConnection) GetServices() ([]plugin_models.GetServices_Model, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.CliConnection.GetServices()
+}
+
+func (s *synchronizedCliConnection) GetService(name string) (plugin_models.GetService_Model, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.CliConnection.GetService(name)
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestSchedulerSkipsDependencyCycle(t *testing.T) {
+	entries := []ServiceManifestEntry{
+		{ServiceName: "a", DependsOn: []string{"b"}},
+		{ServiceName: "b", DependsOn: []string{"a"}},
+	}
+
+	succeeded := newServiceScheduler(nil, entries, 2).run()
+
+	if len(succeeded) != 0 {
+		t.Fatalf("expected no services to succeed in a depends_on cycle, got %v", succeeded)
+	}
+}
+
+func TestSchedulerSkipsUnknownDependency(t *testing.T) {
+	entries := []ServiceManifestEntry{
+		{ServiceName: "a", DependsOn: []string{"typo"}},
+	}
+
+	succeeded := newServiceScheduler(nil, entries, 2).run()
+
+	if len(succeeded) != 0 {
+		t.Fatalf("expected no services to succeed with an unknown dependency, got %v", succeeded)
+	}
+}
+
+func TestSchedulerSkipsTransitiveUnknownDependency(t *testing.T) {
+	entries := []ServiceManifestEntry{
+		{ServiceName: "a", DependsOn: []string{"typo"}},
+		{ServiceName: "b", DependsOn: []string{"a"}},
+	}
+
+	succeeded := newServiceScheduler(nil, entries, 2).run()
+
+	if len(succeeded) != 0 {
+		t.Fatalf("expected no services to succeed when a dependency chain includes an unknown name, got %v", succeeded)
+	}
+}
+
+func TestSchedulerLeavesValidDependencyChainScheduled(t *testing.T) {
+	entries := []ServiceManifestEntry{
+		{ServiceName: "a"},
+		{ServiceName: "b", DependsOn: []string{"a"}},
+	}
+
+	s := newServiceScheduler(nil, entries, 2)
+
+	if len(s.byName) != 2 {
+		t.Fatalf("expected both valid entries to remain scheduled, got %d", len(s.byName))
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State is the top level structure of the plugin's persisted state file,
+// tracking which services this plugin has created so `apply --prune` and
+// `destroy` never touch a service a human created by hand.
+type State struct {
+	Targets map[string]*TargetState `json:"targets"`
+}
+
+// TargetState records every service this plugin manages within one
+// {api_endpoint, org_guid, space_guid} target.
+type TargetState struct {
+	Services map[string]ManagedService `json:"services"`
+}
+
+// ManagedService records enough about a plugin-managed service to detect
+// that it's since been removed from the manifest (for pruning) and when it
+// last successfully converged.
+type ManagedService struct {
+	ManifestHash string    `json:"manifest_hash"`
+	LastSuccess  time.Time `json:"last_success"`
+}
+
+// defaultStateFilePath returns ~/.cf/plugins/create-service-push/state.json.
+func defaultStateFilePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine home directory for the default state file: %s", err)
+	}
+
+	return filepath.Join(home, ".cf", "plugins", "create-service-push", "state.json"), nil
+}
+
+// targetKey identifies one {api_endpoint, org_guid, space_guid} target within
+// the state file.
+func targetKey(apiEndpoint, orgGUID, spaceGUID string) string {
+	return apiEndpoint + "|" + orgGUID + "|" + spaceGUID
+}
+
+// desiredServiceState is the subset of a ServiceManifestEntry's fields that
+// describe the resource itself, as opposed to how the plugin orchestrates
+// it (UpdateService, BindTo, DependsOn). Only these are hashed by
+// serviceManifestHash, so e.g. reordering depends_on or adding a bind_to
+// target doesn't look like drift and trigger an unnecessary re-apply.
+type desiredServiceState struct {
+	ServiceName     string
+	Broker          string
+	PlanName        string
+	JSONParameters  string
+	Type            string
+	Credentials     string
+	CredentialsFile string
+	SyslogDrainURL  string
+	RouteServiceURL string
+}
+
+// serviceManifestHash hashes the parts of entry that describe its desired
+// state, so a changed manifest entry can be told apart from an untouched one.
+func serviceManifestHash(entry ServiceManifestEntry) string {
+	data, _ := json.Marshal(desiredServiceState{
+		ServiceName:     entry.ServiceName,
+		Broker:          entry.Broker,
+		PlanName:        entry.PlanName,
+		JSONParameters:  entry.JSONParameters,
+		Type:            entry.Type,
+		Credentials:     entry.Credentials,
+		CredentialsFile: entry.CredentialsFile,
+		SyslogDrainURL:  entry.SyslogDrainURL,
+		RouteServiceURL: entry.RouteServiceURL,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// manifestHashChanged reports whether entry's manifest hash differs from the
+// one recorded the last time this plugin successfully applied it for target.
+// This is what lets createService/createUserProvidedService detect drift the
+// CF API doesn't expose (changed -c parameters, CUPS credentials), instead of
+// either always reapplying or never reapplying. Returns false - no known
+// drift - when there's nothing recorded to compare against, e.g. stateFilePath
+// is unset or the service hasn't been applied by this plugin before.
+func manifestHashChanged(stateFilePath, target string, entry ServiceManifestEntry) bool {
+	if stateFilePath == "" {
+		return false
+	}
+
+	state, err := loadState(stateFilePath)
+	if err != nil {
+		return false
+	}
+
+	targetState, ok := state.Targets[target]
+	if !ok {
+		return false
+	}
+
+	managed, ok := targetState.Services[entry.ServiceName]
+	if !ok {
+		return false
+	}
+
+	return managed.ManifestHash != serviceManifestHash(entry)
+}
+
+// loadState reads the state file at path, returning an empty State if it
+// doesn't exist yet.
+func loadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &State{Targets: map[string]*TargetState{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state file %s: %s", path, err)
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("unable to parse state file %s: %s", path, err)
+	}
+
+	if state.Targets == nil {
+		state.Targets = map[string]*TargetState{}
+	}
+
+	return &state, nil
+}
+
+// withStateFileLock runs fn while holding an exclusive lock on path+".lock",
+// so concurrent plugin invocations don't clobber each other's state updates.
+func withStateFileLock(path string, fn func() error) error {
+	lockPath := path + ".lock"
+
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return err
+	}
+
+	var lockFile *os.File
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			lockFile = f
+			break
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("unable to acquire lock on %s: %s", lockPath, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer func() {
+		lockFile.Close()
+		os.Remove(lockPath)
+	}()
+
+	return fn()
+}
+
+// recordManaged marks a service as managed by this plugin for the given
+// target, persisting the change immediately.
+func recordManaged(stateFilePath, target, serviceName string, entry ServiceManifestEntry) error {
+	return withStateFileLock(stateFilePath, func() error {
+		state, err := loadState(stateFilePath)
+		if err != nil {
+			return err
+		}
+
+		targetState, ok := state.Targets[target]
+		if !ok {
+			targetState = &TargetState{Services: map[string]ManagedService{}}
+			state.Targets[target] = targetState
+		}
+
+		targetState.Services[serviceName] = ManagedService{
+			ManifestHash: serviceManifestHash(entry),
+			LastSuccess:  time.Now(),
+		}
+
+		return saveStateLocked(stateFilePath, state)
+	})
+}
+
+// saveStateLocked writes state to path without taking the lock itself,
+// for callers (like recordManaged) that already hold it.
+func saveStateLocked(path string, state *State) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// managedServiceNames returns the names of every service recorded as
+// plugin-managed for the given target.
+func managedServiceNames(stateFilePath, target string) (map[string]bool, error) {
+	state, err := loadState(stateFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	if targetState, ok := state.Targets[target]; ok {
+		for name := range targetState.Services {
+			names[name] = true
+		}
+	}
+
+	return names, nil
+}
+
+// forgetManaged removes a service from a target's managed set, persisting
+// the change immediately. Used once a pruned/destroyed service is deleted.
+func forgetManaged(stateFilePath, target, serviceName string) error {
+	return withStateFileLock(stateFilePath, func() error {
+		state, err := loadState(stateFilePath)
+		if err != nil {
+			return err
+		}
+
+		if targetState, ok := state.Targets[target]; ok {
+			delete(targetState.Services, serviceName)
+		}
+
+		return saveStateLocked(stateFilePath, state)
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordManagedAndManagedServiceNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	entry := ServiceManifestEntry{ServiceName: "svc", Broker: "broker", PlanName: "plan"}
+
+	if err := recordManaged(path, "target", "svc", entry); err != nil {
+		t.Fatalf("recordManaged returned an error: %s", err)
+	}
+
+	names, err := managedServiceNames(path, "target")
+	if err != nil {
+		t.Fatalf("managedServiceNames returned an error: %s", err)
+	}
+
+	if !names["svc"] {
+		t.Fatalf("expected svc to be recorded as managed, got %v", names)
+	}
+}
+
+func TestForgetManagedRemovesService(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	entry := ServiceManifestEntry{ServiceName: "svc"}
+
+	if err := recordManaged(path, "target", "svc", entry); err != nil {
+		t.Fatalf("recordManaged returned an error: %s", err)
+	}
+	if err := forgetManaged(path, "target", "svc"); err != nil {
+		t.Fatalf("forgetManaged returned an error: %s", err)
+	}
+
+	names, err := managedServiceNames(path, "target")
+	if err != nil {
+		t.Fatalf("managedServiceNames returned an error: %s", err)
+	}
+	if names["svc"] {
+		t.Fatalf("expected svc to be forgotten, got %v", names)
+	}
+}
+
+func TestManifestHashChangedDetectsDrift(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	original := ServiceManifestEntry{ServiceName: "svc", PlanName: "small"}
+
+	if err := recordManaged(path, "target", "svc", original); err != nil {
+		t.Fatalf("recordManaged returned an error: %s", err)
+	}
+
+	if manifestHashChanged(path, "target", original) {
+		t.Fatalf("expected no drift against the entry that was just recorded")
+	}
+
+	drifted := original
+	drifted.PlanName = "large"
+	if !manifestHashChanged(path, "target", drifted) {
+		t.Fatalf("expected drift once the plan changed")
+	}
+}
+
+func TestManifestHashChangedIgnoresOrchestrationFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	original := ServiceManifestEntry{ServiceName: "svc", PlanName: "small"}
+
+	if err := recordManaged(path, "target", "svc", original); err != nil {
+		t.Fatalf("recordManaged returned an error: %s", err)
+	}
+
+	reordered := original
+	reordered.UpdateService = true
+	reordered.BindTo = []string{"app"}
+	reordered.DependsOn = []string{"other"}
+
+	if manifestHashChanged(path, "target", reordered) {
+		t.Fatalf("expected no drift from changing only orchestration fields (update_service/bind_to/depends_on)")
+	}
+}
+
+func TestManifestHashChangedWithNoStateFile(t *testing.T) {
+	if manifestHashChanged("", "target", ServiceManifestEntry{ServiceName: "svc"}) {
+		t.Fatalf("expected no drift to be reported without a state file")
+	}
+}